@@ -0,0 +1,326 @@
+/*
+Copyright 2021 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+
+	"github.com/dapr/components-contrib/bindings"
+	"github.com/dapr/components-contrib/metadata"
+	"github.com/dapr/kit/logger"
+)
+
+const (
+	defaultLeaseCollection = "leases"
+	defaultLeasePrefix     = "dapr"
+	defaultLeaseTTL        = 60 * time.Second
+	defaultParallelism     = 1
+)
+
+// ChangeFeed is an input binding that tails the Cosmos DB change feed of a
+// container and invokes the app once per batch of changed documents.
+// Progress is checkpointed per physical partition (feed range) in a separate
+// lease container so that the binding can resume where it left off across
+// restarts.
+type ChangeFeed struct {
+	container      *azcosmos.ContainerClient
+	leaseContainer *azcosmos.ContainerClient
+
+	leasePrefix        string
+	leaseTTL           time.Duration
+	startFromBeginning bool
+	startFromTimestamp *time.Time
+	parallelism        int
+
+	logger logger.Logger
+
+	closeCh chan struct{}
+	closeWG sync.WaitGroup
+}
+
+type changeFeedMetadata struct {
+	URL                string `mapstructure:"url"`
+	MasterKey          string `mapstructure:"masterKey"`
+	Database           string `mapstructure:"database"`
+	Collection         string `mapstructure:"collection"`
+	LeaseCollection    string `mapstructure:"leaseCollection"`
+	LeasePrefix        string `mapstructure:"leasePrefix"`
+	LeaseTTLInSeconds  string `mapstructure:"leaseTTLInSeconds"`
+	StartFromBeginning string `mapstructure:"startFromBeginning"`
+	StartFromTimestamp string `mapstructure:"startFromTimestamp"`
+	Parallelism        string `mapstructure:"parallelism"`
+}
+
+// lease records the last continuation token successfully delivered to the app
+// for a given feed range, so a restart resumes instead of redelivering.
+type lease struct {
+	ID                string `json:"id"`
+	PartitionKey      string `json:"partitionKey"`
+	FeedRange         string `json:"feedRange"`
+	ContinuationToken string `json:"continuationToken,omitempty"`
+	TTL               int32  `json:"ttl,omitempty"`
+}
+
+// NewCosmosDBChangeFeedInput returns a new Cosmos DB change feed input binding instance.
+func NewCosmosDBChangeFeedInput(logger logger.Logger) bindings.InputBinding {
+	return &ChangeFeed{logger: logger, closeCh: make(chan struct{})}
+}
+
+// Init parses connection and checkpointing metadata and prepares the lease container.
+func (c *ChangeFeed) Init(ctx context.Context, md bindings.Metadata) error {
+	var m changeFeedMetadata
+	if err := metadata.DecodeMetadata(md.Properties, &m); err != nil {
+		return err
+	}
+
+	if m.URL == "" {
+		return fmt.Errorf("missing url field from metadata")
+	}
+	if m.MasterKey == "" {
+		return fmt.Errorf("missing masterKey field from metadata")
+	}
+	if m.Database == "" {
+		return fmt.Errorf("missing database field from metadata")
+	}
+	if m.Collection == "" {
+		return fmt.Errorf("missing collection field from metadata")
+	}
+
+	cred, err := azcosmos.NewKeyCredential(m.MasterKey)
+	if err != nil {
+		return fmt.Errorf("error creating CosmosDB credentials: %w", err)
+	}
+
+	client, err := azcosmos.NewClientWithKey(m.URL, cred, nil)
+	if err != nil {
+		return fmt.Errorf("error creating CosmosDB client: %w", err)
+	}
+
+	container, err := client.NewContainer(m.Database, m.Collection)
+	if err != nil {
+		return fmt.Errorf("error creating CosmosDB container client: %w", err)
+	}
+
+	leaseCollection := m.LeaseCollection
+	if leaseCollection == "" {
+		leaseCollection = defaultLeaseCollection
+	}
+	leaseContainer, err := client.NewContainer(m.Database, leaseCollection)
+	if err != nil {
+		return fmt.Errorf("error creating CosmosDB lease container client: %w", err)
+	}
+
+	c.container = container
+	c.leaseContainer = leaseContainer
+
+	c.leasePrefix = m.LeasePrefix
+	if c.leasePrefix == "" {
+		c.leasePrefix = defaultLeasePrefix
+	}
+
+	c.leaseTTL = defaultLeaseTTL
+	if m.LeaseTTLInSeconds != "" {
+		seconds, parseErr := strconv.Atoi(m.LeaseTTLInSeconds)
+		if parseErr != nil {
+			return fmt.Errorf("leaseTTLInSeconds must be an integer: %w", parseErr)
+		}
+		c.leaseTTL = time.Duration(seconds) * time.Second
+	}
+
+	c.parallelism = defaultParallelism
+	if m.Parallelism != "" {
+		parallelism, parseErr := strconv.Atoi(m.Parallelism)
+		if parseErr != nil {
+			return fmt.Errorf("parallelism must be an integer: %w", parseErr)
+		}
+		if parallelism < 1 {
+			return fmt.Errorf("parallelism must be at least 1")
+		}
+		c.parallelism = parallelism
+	}
+
+	c.startFromBeginning = m.StartFromBeginning == "true"
+
+	if m.StartFromTimestamp != "" {
+		ts, parseErr := time.Parse(time.RFC3339, m.StartFromTimestamp)
+		if parseErr != nil {
+			return fmt.Errorf("startFromTimestamp must be an RFC3339 timestamp: %w", parseErr)
+		}
+		c.startFromTimestamp = &ts
+	}
+
+	return nil
+}
+
+// Read starts tailing the change feed, invoking handler once per batch of
+// changes on each physical partition, and returns once the consumers are
+// started; they run until ctx is canceled or Close is called.
+func (c *ChangeFeed) Read(ctx context.Context, handler bindings.Handler) error {
+	ranges, err := c.feedRanges(ctx)
+	if err != nil {
+		return fmt.Errorf("cosmosdb change feed binding error: %w", err)
+	}
+
+	sem := make(chan struct{}, c.parallelism)
+	for _, feedRange := range ranges {
+		feedRange := feedRange
+		c.closeWG.Add(1)
+		go func() {
+			defer c.closeWG.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			c.consumeRange(ctx, feedRange, handler)
+		}()
+	}
+
+	return nil
+}
+
+// Close stops all in-flight change feed consumers, waiting for the last
+// successful continuation token of each to be flushed to its lease.
+func (c *ChangeFeed) Close() error {
+	close(c.closeCh)
+	c.closeWG.Wait()
+	return nil
+}
+
+// feedRanges enumerates the physical partition feed ranges of the monitored
+// container via the SDK's own partition topology, rather than any property of
+// the documents stored in it, so that one goroutine maps to one physical
+// partition regardless of how many documents the container holds.
+func (c *ChangeFeed) feedRanges(ctx context.Context) ([]azcosmos.FeedRange, error) {
+	resp, err := c.container.GetFeedRanges(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.FeedRanges, nil
+}
+
+// leaseID identifies the lease for a feed range by the range's own stable
+// identifier rather than its position in the slice returned by feedRanges:
+// a partition split changes both the count and order of feed ranges, which
+// would silently point an index-based id at a different physical range.
+func (c *ChangeFeed) leaseID(feedRange azcosmos.FeedRange) string {
+	return fmt.Sprintf("%s-%s", c.leasePrefix, feedRange.String())
+}
+
+func (c *ChangeFeed) loadLease(ctx context.Context, feedRange azcosmos.FeedRange) (*lease, error) {
+	id := c.leaseID(feedRange)
+	resp, err := c.leaseContainer.ReadItem(ctx, azcosmos.NewPartitionKeyString(id), id, nil)
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return &lease{ID: id, PartitionKey: id, FeedRange: feedRange.String()}, nil
+		}
+		return nil, err
+	}
+
+	var l lease
+	if err := json.Unmarshal(resp.Value, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (c *ChangeFeed) saveLease(ctx context.Context, l *lease) error {
+	l.TTL = int32(c.leaseTTL.Seconds())
+	body, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	_, err = c.leaseContainer.UpsertItem(ctx, azcosmos.NewPartitionKeyString(l.PartitionKey), body, nil)
+	return err
+}
+
+// consumeRange polls the change feed of a single feed range, checkpointing
+// after each batch is successfully handed to the app, until ctx is canceled
+// or Close is called.
+func (c *ChangeFeed) consumeRange(ctx context.Context, feedRange azcosmos.FeedRange, handler bindings.Handler) {
+	l, err := c.loadLease(ctx, feedRange)
+	if err != nil {
+		c.logger.Errorf("cosmosdb change feed binding: unable to load lease for range %s: %v", feedRange.String(), err)
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.closeCh:
+			return
+		default:
+		}
+
+		opts := &azcosmos.ChangeFeedOptions{}
+		switch {
+		case l.ContinuationToken != "":
+			opts.ContinuationToken = &l.ContinuationToken
+		case c.startFromTimestamp != nil:
+			opts.StartTime = c.startFromTimestamp
+		case c.startFromBeginning:
+			opts.StartFromBeginning = true
+		}
+
+		pager := c.container.NewQueryChangeFeedPager(feedRange, opts)
+		for pager.More() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.closeCh:
+				return
+			default:
+			}
+
+			page, pageErr := pager.NextPage(ctx)
+			if pageErr != nil {
+				c.logger.Errorf("cosmosdb change feed binding: error reading range %s: %v", feedRange.String(), pageErr)
+				time.Sleep(time.Second)
+				break
+			}
+
+			if len(page.Items) > 0 {
+				batch := make([]json.RawMessage, 0, len(page.Items))
+				for _, item := range page.Items {
+					batch = append(batch, json.RawMessage(item))
+				}
+				data, marshalErr := json.Marshal(batch)
+				if marshalErr != nil {
+					c.logger.Errorf("cosmosdb change feed binding: unable to marshal batch for range %s: %v", feedRange.String(), marshalErr)
+					break
+				}
+				if _, handlerErr := handler(ctx, &bindings.ReadResponse{Data: data}); handlerErr != nil {
+					c.logger.Errorf("cosmosdb change feed binding: app handler error for range %s: %v", feedRange.String(), handlerErr)
+					break
+				}
+			}
+
+			l.ContinuationToken = page.ContinuationToken
+			if err := c.saveLease(ctx, l); err != nil {
+				c.logger.Errorf("cosmosdb change feed binding: unable to checkpoint lease for range %s: %v", feedRange.String(), err)
+			}
+		}
+
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,529 @@
+/*
+Copyright 2021 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cosmosdb implements an output binding on top of Azure Cosmos DB's
+// SQL (core) API, and an input binding that tails the Cosmos DB change feed.
+package cosmosdb
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+
+	"github.com/dapr/components-contrib/bindings"
+	"github.com/dapr/components-contrib/metadata"
+	"github.com/dapr/kit/logger"
+)
+
+const (
+	// CreateOperation creates a new document.
+	CreateOperation bindings.OperationKind = "create"
+	// UpsertOperation creates a document, replacing it if one with the same id and partition key already exists.
+	UpsertOperation bindings.OperationKind = "upsert"
+	// ReplaceOperation replaces an existing document in its entirety.
+	ReplaceOperation bindings.OperationKind = "replace"
+	// PatchOperation applies a partial update to an existing document.
+	PatchOperation bindings.OperationKind = "patch"
+	// DeleteOperation deletes an existing document.
+	DeleteOperation bindings.OperationKind = "delete"
+	// QueryOperation runs a SQL query and returns the matching documents.
+	QueryOperation bindings.OperationKind = "query"
+	// GetOperation fetches a single document by id and partition key.
+	GetOperation bindings.OperationKind = "get"
+
+	metadataKeyID                   = "id"
+	metadataKeyPartitionKey         = "partitionKey"
+	metadataKeyEnableCrossPartition = "enableCrossPartition"
+	metadataKeyMaxItemCount         = "maxItemCount"
+	metadataKeyContinuationToken    = "continuationToken"
+)
+
+// CosmosDB allows performing state operations on collections stored on Azure Cosmos DB.
+type CosmosDB struct {
+	client *azcosmos.ContainerClient
+	// partitionKeyPaths holds the document field(s) the partition key is read from,
+	// in order. A single entry is the common case; up to three entries describe a
+	// hierarchical (sub-)partition key.
+	partitionKeyPaths []string
+
+	logger logger.Logger
+}
+
+type cosmosDBCredentials struct {
+	URL          string `mapstructure:"url"`
+	MasterKey    string `mapstructure:"masterKey"`
+	Database     string `mapstructure:"database"`
+	Collection   string `mapstructure:"collection"`
+	PartitionKey string `mapstructure:"partitionKey"`
+	// SkipCertVerification (alias BypassTLSVerify) lets the binding point at the
+	// Cosmos DB emulator or a local test double, both of which serve a
+	// self-signed certificate. It must never be set against a production account.
+	SkipCertVerification string `mapstructure:"skipCertVerification"`
+	BypassTLSVerify      string `mapstructure:"bypassTLSVerify"`
+}
+
+// NewCosmosDB returns a new CosmosDB output binding instance.
+func NewCosmosDB(logger logger.Logger) bindings.OutputBinding {
+	return &CosmosDB{logger: logger}
+}
+
+// Init performs CosmosDB connection parsing.
+func (c *CosmosDB) Init(ctx context.Context, metadata bindings.Metadata) error {
+	m, err := parseMetadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	cred, err := azcosmos.NewKeyCredential(m.MasterKey)
+	if err != nil {
+		return fmt.Errorf("error creating CosmosDB credentials: %w", err)
+	}
+
+	clientOpts, err := clientOptionsForMetadata(m)
+	if err != nil {
+		return err
+	}
+
+	client, err := azcosmos.NewClientWithKey(m.URL, cred, clientOpts)
+	if err != nil {
+		return fmt.Errorf("error creating CosmosDB client: %w", err)
+	}
+
+	container, err := client.NewContainer(m.Database, m.Collection)
+	if err != nil {
+		return fmt.Errorf("error creating CosmosDB container client: %w", err)
+	}
+
+	paths, err := parsePartitionKeyPaths(m.PartitionKey)
+	if err != nil {
+		return err
+	}
+
+	c.client = container
+	c.partitionKeyPaths = paths
+
+	return nil
+}
+
+// parsePartitionKeyPaths accepts either a single JSON path (the common case)
+// or a JSON array of up to three paths describing a hierarchical partition key.
+func parsePartitionKeyPaths(raw string) ([]string, error) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return []string{metadataKeyPartitionKey}, nil
+	}
+
+	if strings.HasPrefix(trimmed, "[") {
+		var paths []string
+		if err := json.Unmarshal([]byte(trimmed), &paths); err != nil {
+			return nil, fmt.Errorf("partitionKey metadata field must be a string or a JSON array of strings: %w", err)
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("partitionKey metadata field must contain at least one path")
+		}
+		if len(paths) > 3 {
+			return nil, fmt.Errorf("partitionKey metadata field supports at most 3 hierarchical levels, got %d", len(paths))
+		}
+		return paths, nil
+	}
+
+	return []string{trimmed}, nil
+}
+
+// clientOptionsForMetadata builds azcosmos.ClientOptions that skip TLS
+// certificate verification when the binding is configured to talk to the
+// Cosmos DB emulator or an in-process test double, both of which present a
+// self-signed certificate that a production client would otherwise reject.
+func clientOptionsForMetadata(m *cosmosDBCredentials) (*azcosmos.ClientOptions, error) {
+	skip := m.SkipCertVerification == "true" || m.BypassTLSVerify == "true"
+	if !skip {
+		return nil, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec // opt-in, emulator/test-only
+
+	return &azcosmos.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			Transport: &http.Client{Transport: transport},
+		},
+	}, nil
+}
+
+func parseMetadata(md bindings.Metadata) (*cosmosDBCredentials, error) {
+	var m cosmosDBCredentials
+	if err := metadata.DecodeMetadata(md.Properties, &m); err != nil {
+		return nil, err
+	}
+
+	if m.URL == "" {
+		return nil, fmt.Errorf("missing url field from metadata")
+	}
+	if m.MasterKey == "" {
+		return nil, fmt.Errorf("missing masterKey field from metadata")
+	}
+	if m.Database == "" {
+		return nil, fmt.Errorf("missing database field from metadata")
+	}
+	if m.Collection == "" {
+		return nil, fmt.Errorf("missing collection field from metadata")
+	}
+
+	return &m, nil
+}
+
+// Operations returns the supported operations for this binding.
+func (c *CosmosDB) Operations() []bindings.OperationKind {
+	return []bindings.OperationKind{
+		CreateOperation,
+		UpsertOperation,
+		ReplaceOperation,
+		PatchOperation,
+		DeleteOperation,
+		QueryOperation,
+		GetOperation,
+	}
+}
+
+// Invoke dispatches the request to the operation-specific handler.
+func (c *CosmosDB) Invoke(ctx context.Context, req *bindings.InvokeRequest) (*bindings.InvokeResponse, error) {
+	switch req.Operation {
+	case CreateOperation:
+		return c.create(ctx, req)
+	case UpsertOperation:
+		return c.upsert(ctx, req)
+	case ReplaceOperation:
+		return c.replace(ctx, req)
+	case PatchOperation:
+		return c.patch(ctx, req)
+	case DeleteOperation:
+		return c.delete(ctx, req)
+	case QueryOperation:
+		return c.query(ctx, req)
+	case GetOperation:
+		return c.get(ctx, req)
+	default:
+		return nil, fmt.Errorf("cosmosdb binding error: unsupported operation %s", req.Operation)
+	}
+}
+
+// partitionKeyFromDocument extracts the partition key from a document body,
+// walking c.partitionKeyPaths in order to build a composite value for
+// hierarchical (sub-)partition keys.
+func (c *CosmosDB) partitionKeyFromDocument(document map[string]interface{}) (azcosmos.PartitionKey, error) {
+	if len(c.partitionKeyPaths) == 1 {
+		path := c.partitionKeyPaths[0]
+		v, ok := document[path]
+		if !ok {
+			return azcosmos.PartitionKey{}, fmt.Errorf("missing %s field: %w", path, ErrMissingPartitionKey)
+		}
+		s, ok := v.(string)
+		if !ok {
+			return azcosmos.PartitionKey{}, fmt.Errorf("%s field must be a string", path)
+		}
+		return azcosmos.NewPartitionKeyString(s), nil
+	}
+
+	builder := azcosmos.NewPartitionKeyBuilder()
+	for level, path := range c.partitionKeyPaths {
+		v, ok := document[path]
+		if !ok {
+			return azcosmos.PartitionKey{}, fmt.Errorf("missing %s field (partition key level %d): %w", path, level+1, ErrMissingPartitionKey)
+		}
+		s, ok := v.(string)
+		if !ok {
+			return azcosmos.PartitionKey{}, fmt.Errorf("%s field must be a string (partition key level %d)", path, level+1)
+		}
+		builder.AppendString(s)
+	}
+
+	return builder.Build(), nil
+}
+
+func (c *CosmosDB) create(ctx context.Context, req *bindings.InvokeRequest) (*bindings.InvokeResponse, error) {
+	var document map[string]interface{}
+	if err := json.Unmarshal(req.Data, &document); err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: unable to parse document: %w", err)
+	}
+
+	pk, err := c.partitionKeyFromDocument(document)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: %w", err)
+	}
+
+	resp, err := c.client.CreateItem(ctx, pk, req.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: %w", wrapCosmosError(err))
+	}
+
+	return &bindings.InvokeResponse{Metadata: responseMetadata(resp)}, nil
+}
+
+func (c *CosmosDB) upsert(ctx context.Context, req *bindings.InvokeRequest) (*bindings.InvokeResponse, error) {
+	var document map[string]interface{}
+	if err := json.Unmarshal(req.Data, &document); err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: unable to parse document: %w", err)
+	}
+
+	pk, err := c.partitionKeyFromDocument(document)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: %w", err)
+	}
+
+	resp, err := c.client.UpsertItem(ctx, pk, req.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: %w", wrapCosmosError(err))
+	}
+
+	return &bindings.InvokeResponse{Metadata: responseMetadata(resp)}, nil
+}
+
+func (c *CosmosDB) replace(ctx context.Context, req *bindings.InvokeRequest) (*bindings.InvokeResponse, error) {
+	var document map[string]interface{}
+	if err := json.Unmarshal(req.Data, &document); err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: unable to parse document: %w", err)
+	}
+
+	id, ok := document[metadataKeyID].(string)
+	if !ok || id == "" {
+		return nil, fmt.Errorf("cosmosdb binding error: missing %s field", metadataKeyID)
+	}
+
+	pk, err := c.partitionKeyFromDocument(document)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: %w", err)
+	}
+
+	resp, err := c.client.ReplaceItem(ctx, pk, id, req.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: %w", wrapCosmosError(err))
+	}
+
+	return &bindings.InvokeResponse{Metadata: responseMetadata(resp)}, nil
+}
+
+func (c *CosmosDB) delete(ctx context.Context, req *bindings.InvokeRequest) (*bindings.InvokeResponse, error) {
+	id, pk, err := c.idAndPartitionKeyFromMetadata(req.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: %w", err)
+	}
+
+	resp, err := c.client.DeleteItem(ctx, pk, id, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: %w", wrapCosmosError(err))
+	}
+
+	return &bindings.InvokeResponse{Metadata: responseMetadata(resp)}, nil
+}
+
+// patchRequest is the body shape accepted by the patch operation: an ordered
+// list of JSON-patch-style operations applied server-side in a single request.
+type patchRequest struct {
+	Operations []patchOperation `json:"operations"`
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+func (c *CosmosDB) patch(ctx context.Context, req *bindings.InvokeRequest) (*bindings.InvokeResponse, error) {
+	id, pk, err := c.idAndPartitionKeyFromMetadata(req.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: %w", err)
+	}
+
+	var pr patchRequest
+	if err := json.Unmarshal(req.Data, &pr); err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: unable to parse patch operations: %w", err)
+	}
+
+	patch := azcosmos.PatchOperations{}
+	for _, op := range pr.Operations {
+		switch op.Op {
+		case "add":
+			patch.AppendAdd(op.Path, op.Value)
+		case "set":
+			patch.AppendSet(op.Path, op.Value)
+		case "replace":
+			patch.AppendReplace(op.Path, op.Value)
+		case "remove":
+			patch.AppendRemove(op.Path)
+		case "incr":
+			incr, ok := op.Value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("cosmosdb binding error: incr operation requires a numeric value for path %s", op.Path)
+			}
+			patch.AppendIncrement(op.Path, int64(incr))
+		default:
+			return nil, fmt.Errorf("cosmosdb binding error: unsupported patch op %q for path %s", op.Op, op.Path)
+		}
+	}
+
+	resp, err := c.client.PatchItem(ctx, pk, id, patch, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: %w", wrapCosmosError(err))
+	}
+
+	return &bindings.InvokeResponse{Metadata: responseMetadata(resp)}, nil
+}
+
+// idAndPartitionKeyFromMetadata reads the id and partitionKey fields that
+// operations without a document body (patch, delete, get) expect in metadata.
+func (c *CosmosDB) idAndPartitionKeyFromMetadata(md map[string]string) (string, azcosmos.PartitionKey, error) {
+	id, ok := md[metadataKeyID]
+	if !ok || id == "" {
+		return "", azcosmos.PartitionKey{}, fmt.Errorf("missing %s metadata field", metadataKeyID)
+	}
+
+	pkValue, ok := md[metadataKeyPartitionKey]
+	if !ok || pkValue == "" {
+		return "", azcosmos.PartitionKey{}, fmt.Errorf("missing %s metadata field", metadataKeyPartitionKey)
+	}
+
+	pk, err := c.partitionKeyFromMetadataValue(pkValue)
+	if err != nil {
+		return "", azcosmos.PartitionKey{}, err
+	}
+
+	return id, pk, nil
+}
+
+// partitionKeyFromMetadataValue parses the partitionKey metadata value for
+// operations that don't carry a document body. A single-level partition key
+// is passed as a plain string; a hierarchical one is passed as a JSON array
+// with one value per level in c.partitionKeyPaths.
+func (c *CosmosDB) partitionKeyFromMetadataValue(raw string) (azcosmos.PartitionKey, error) {
+	if len(c.partitionKeyPaths) == 1 {
+		return azcosmos.NewPartitionKeyString(raw), nil
+	}
+
+	var values []string
+	if err := json.Unmarshal([]byte(raw), &values); err != nil {
+		return azcosmos.PartitionKey{}, fmt.Errorf("partitionKey metadata field must be a JSON array of %d values for this hierarchical partition key: %w", len(c.partitionKeyPaths), err)
+	}
+	if len(values) != len(c.partitionKeyPaths) {
+		return azcosmos.PartitionKey{}, fmt.Errorf("partitionKey metadata field must contain exactly %d values, got %d", len(c.partitionKeyPaths), len(values))
+	}
+
+	builder := azcosmos.NewPartitionKeyBuilder()
+	for _, v := range values {
+		builder.AppendString(v)
+	}
+
+	return builder.Build(), nil
+}
+
+// queryRequest is the body shape accepted by the query operation: a SQL
+// query string plus the named parameters it references, mirroring
+// documentdb.Parameter so callers migrating from the legacy SDK can reuse
+// the same shape.
+type queryRequest struct {
+	Query      string           `json:"query"`
+	Parameters []queryParameter `json:"parameters"`
+}
+
+type queryParameter struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+func (c *CosmosDB) query(ctx context.Context, req *bindings.InvokeRequest) (*bindings.InvokeResponse, error) {
+	var qr queryRequest
+	if err := json.Unmarshal(req.Data, &qr); err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: unable to parse query: %w", err)
+	}
+
+	params := make([]azcosmos.QueryParameter, 0, len(qr.Parameters))
+	for _, p := range qr.Parameters {
+		params = append(params, azcosmos.QueryParameter{Name: p.Name, Value: p.Value})
+	}
+
+	opts := &azcosmos.QueryOptions{QueryParameters: params}
+	if maxItemCount, ok := req.Metadata[metadataKeyMaxItemCount]; ok {
+		n, err := strconv.Atoi(maxItemCount)
+		if err != nil {
+			return nil, fmt.Errorf("cosmosdb binding error: %s must be an integer", metadataKeyMaxItemCount)
+		}
+		opts.PageSizeHint = int32(n)
+	}
+	if token, ok := req.Metadata[metadataKeyContinuationToken]; ok && token != "" {
+		opts.ContinuationToken = &token
+	}
+
+	pk := azcosmos.NewPartitionKey()
+	if req.Metadata[metadataKeyEnableCrossPartition] != "true" {
+		if pkValue, ok := req.Metadata[metadataKeyPartitionKey]; ok && pkValue != "" {
+			var pkErr error
+			pk, pkErr = c.partitionKeyFromMetadataValue(pkValue)
+			if pkErr != nil {
+				return nil, fmt.Errorf("cosmosdb binding error: %w", pkErr)
+			}
+		}
+	}
+
+	pager := c.client.NewQueryItemsPager(qr.Query, pk, opts)
+
+	// Fetch exactly one page per Invoke call: maxItemCount/continuationToken
+	// let the caller page through a large result set across multiple Invoke
+	// calls instead of this one call draining it to completion.
+	var documents []json.RawMessage
+	md := map[string]string{metadataKeyContinuationToken: ""}
+	if pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cosmosdb binding error: %w", wrapCosmosError(err))
+		}
+
+		for _, item := range page.Items {
+			documents = append(documents, json.RawMessage(item))
+		}
+		for k, v := range queryPageMetadata(page) {
+			md[k] = v
+		}
+		md[metadataKeyContinuationToken] = page.ContinuationToken
+	}
+
+	body, err := json.Marshal(documents)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: unable to marshal query results: %w", err)
+	}
+
+	return &bindings.InvokeResponse{
+		Data:     body,
+		Metadata: md,
+	}, nil
+}
+
+func (c *CosmosDB) get(ctx context.Context, req *bindings.InvokeRequest) (*bindings.InvokeResponse, error) {
+	id, pk, err := c.idAndPartitionKeyFromMetadata(req.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: %w", err)
+	}
+
+	resp, err := c.client.ReadItem(ctx, pk, id, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cosmosdb binding error: %w", wrapCosmosError(err))
+	}
+
+	md := responseMetadata(resp)
+	return &bindings.InvokeResponse{Data: resp.Value, Metadata: md}, nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2021 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cosmosdb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// Sentinel errors returned by the operations in this package. Callers should
+// use errors.Is/errors.As against these instead of matching on error strings;
+// use errors.As with *CosmosError to recover the underlying status code,
+// Cosmos error code, and (for ErrThrottled) the server-suggested retry delay.
+var (
+	ErrMissingPartitionKey  = errors.New("missing partition key field")
+	ErrPartitionKeyMismatch = errors.New("partition key extracted from document doesn't match the one specified in the header")
+	ErrDocumentNotFound     = errors.New("document not found")
+	ErrConflict             = errors.New("document already exists")
+	ErrThrottled            = errors.New("request rate too large")
+)
+
+// CosmosError wraps an error returned by the Cosmos DB service with the
+// status code and Cosmos error code it came back with, so applications can
+// implement backoff and cost-aware routing without parsing response bodies.
+type CosmosError struct {
+	// StatusCode is the HTTP status code the Cosmos DB service responded with.
+	StatusCode int
+	// Code is the Cosmos DB error code (e.g. "PartitionKeyMismatch"), when the service provided one.
+	Code string
+	// RetryAfter is set on ErrThrottled and reflects the server's x-ms-retry-after-ms hint.
+	RetryAfter time.Duration
+
+	sentinel error
+	cause    error
+}
+
+func (e *CosmosError) Error() string {
+	return fmt.Sprintf("%s (status code %d): %s", e.sentinel, e.StatusCode, e.cause)
+}
+
+// Unwrap exposes the sentinel so errors.Is(err, ErrDocumentNotFound) and
+// friends work without callers needing to know about CosmosError at all.
+func (e *CosmosError) Unwrap() error {
+	return e.sentinel
+}
+
+// wrapCosmosError inspects err for an azcore.ResponseError and, when it
+// recognizes the status code or Cosmos error code, wraps it into a
+// *CosmosError carrying the matching sentinel above. Errors that don't
+// originate from the Cosmos DB service, or that don't match a known case,
+// are returned unchanged.
+func wrapCosmosError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return err
+	}
+
+	ce := &CosmosError{
+		StatusCode: respErr.StatusCode,
+		Code:       respErr.ErrorCode,
+		cause:      err,
+	}
+
+	switch respErr.StatusCode {
+	case http.StatusNotFound:
+		ce.sentinel = ErrDocumentNotFound
+	case http.StatusConflict:
+		ce.sentinel = ErrConflict
+	case http.StatusTooManyRequests:
+		ce.sentinel = ErrThrottled
+		if respErr.RawResponse != nil {
+			if ms, convErr := strconv.Atoi(respErr.RawResponse.Header.Get("x-ms-retry-after-ms")); convErr == nil {
+				ce.RetryAfter = time.Duration(ms) * time.Millisecond
+			}
+		}
+	case http.StatusBadRequest:
+		switch {
+		case strings.Contains(respErr.Error(), "doesn't match the one specified in the header"):
+			ce.sentinel = ErrPartitionKeyMismatch
+		default:
+			return err
+		}
+	default:
+		return err
+	}
+
+	return ce
+}
+
+// responseMetadata extracts the statusCode, requestCharge, and activityId
+// that every successful (and failed) Cosmos DB request reports, so the
+// binding can surface them to the app without the app needing its own Cosmos
+// client.
+func responseMetadata(resp azcosmos.ItemResponse) map[string]string {
+	md := map[string]string{
+		"activityId":    resp.ActivityID,
+		"requestCharge": strconv.FormatFloat(resp.RequestCharge, 'f', -1, 64),
+	}
+	if resp.RawResponse != nil {
+		md["statusCode"] = strconv.Itoa(resp.RawResponse.StatusCode)
+	}
+	return md
+}
+
+// queryPageMetadata is responseMetadata's counterpart for a single query
+// page: query results are RU-cost-sensitive exactly like every other
+// operation, so callers get the same statusCode/requestCharge/activityId here too.
+func queryPageMetadata(page azcosmos.QueryItemsResponse) map[string]string {
+	md := map[string]string{
+		"activityId":    page.ActivityID,
+		"requestCharge": strconv.FormatFloat(page.RequestCharge, 'f', -1, 64),
+	}
+	if page.RawResponse != nil {
+		md["statusCode"] = strconv.Itoa(page.RawResponse.StatusCode)
+	}
+	return md
+}
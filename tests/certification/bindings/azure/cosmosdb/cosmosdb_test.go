@@ -17,6 +17,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -36,6 +37,7 @@ import (
 
 	"github.com/dapr/components-contrib/tests/certification/embedded"
 	"github.com/dapr/components-contrib/tests/certification/flow"
+	"github.com/dapr/components-contrib/tests/certification/flow/app"
 	"github.com/dapr/components-contrib/tests/certification/flow/sidecar"
 
 	"github.com/a8m/documentdb"
@@ -73,7 +75,7 @@ func TestCosmosDBBinding(t *testing.T) {
 
 	log := logger.NewLogger("dapr.components")
 
-	invokeCreateWithDocument := func(ctx flow.Context, document map[string]interface{}) error {
+	invokeWithDocument := func(ctx flow.Context, operation string, document map[string]interface{}, metadata map[string]string) error {
 		client, clientErr := daprsdk.NewClientWithPort(fmt.Sprint(currentGRPCPort))
 		if clientErr != nil {
 			panic(clientErr)
@@ -87,26 +89,22 @@ func TestCosmosDBBinding(t *testing.T) {
 
 		invokeRequest := &daprsdk.InvokeBindingRequest{
 			Name:      "azure-cosmosdb-binding",
-			Operation: "create",
+			Operation: operation,
 			Data:      bytesDoc,
-			Metadata:  nil,
+			Metadata:  metadata,
 		}
 
 		err = client.InvokeOutputBinding(ctx, invokeRequest)
 		return err
 	}
 
-	testInvokeCreateAndVerify := func(ctx flow.Context) error {
-		document := createDocument(true, true)
-		invokeErr := invokeCreateWithDocument(ctx, document)
-		assert.NoError(t, invokeErr)
-
-		// sleep to avoid metdata request rate limit before initializing new client
-		flow.Sleep(3 * time.Second)
+	invokeCreateWithDocument := func(ctx flow.Context, document map[string]interface{}) error {
+		return invokeWithDocument(ctx, "create", document, nil)
+	}
 
-		// all environment variables loaded here are also loaded in the component definition YAML files
-		// these are generated by the setup-azure-conf-test.sh script and injected by the GitHub Workflow, or by
-		// locally sourcing the generated .rc file
+	// queryDocumentByID connects directly to Cosmos DB (bypassing the binding under test)
+	// so assertions can verify what was actually persisted.
+	queryDocumentByID := func(id string) (map[string]interface{}, *documentdb.Collection, *documentdb.DocumentDB) {
 		config := documentdb.NewConfig(&documentdb.Key{
 			Key: os.Getenv("AzureCosmosDBMasterKey"),
 		})
@@ -133,14 +131,31 @@ func TestCosmosDBBinding(t *testing.T) {
 		var items []map[string]interface{}
 		_, queryErr := dbclient.QueryDocuments(
 			collection.Self,
-			documentdb.NewQuery("SELECT * FROM ROOT r WHERE r.id=@id", documentdb.P{Name: "@id", Value: document["id"].(string)}),
+			documentdb.NewQuery("SELECT * FROM ROOT r WHERE r.id=@id", documentdb.P{Name: "@id", Value: id}),
 			&items,
 			documentdb.CrossPartition(),
 		)
-
 		assert.NoError(t, queryErr)
+		if len(items) == 0 {
+			return nil, collection, dbclient
+		}
+
+		return items[0], collection, dbclient
+	}
+
+	testInvokeCreateAndVerify := func(ctx flow.Context) error {
+		document := createDocument(true, true)
+		invokeErr := invokeCreateWithDocument(ctx, document)
+		assert.NoError(t, invokeErr)
+
+		// sleep to avoid metdata request rate limit before initializing new client
+		flow.Sleep(3 * time.Second)
+
+		// all environment variables loaded here are also loaded in the component definition YAML files
+		// these are generated by the setup-azure-conf-test.sh script and injected by the GitHub Workflow, or by
+		// locally sourcing the generated .rc file
+		result, _, dbclient := queryDocumentByID(document["id"].(string))
 
-		result := items[0]
 		// verify the item retrieved from the database matches the item we inserted
 		assert.Equal(t, document["id"], result["id"])
 		assert.Equal(t, document["orderid"], result["orderid"])
@@ -155,6 +170,222 @@ func TestCosmosDBBinding(t *testing.T) {
 		return nil
 	}
 
+	testInvokeUpsertAndVerify := func(ctx flow.Context) error {
+		document := createDocument(true, true)
+		invokeErr := invokeWithDocument(ctx, "upsert", document, nil)
+		assert.NoError(t, invokeErr)
+
+		flow.Sleep(3 * time.Second)
+
+		result, _, dbclient := queryDocumentByID(document["id"].(string))
+		assert.Equal(t, document["id"], result["id"])
+		assert.Equal(t, document["orderid"], result["orderid"])
+
+		// upserting the same id/partition key again should replace, not duplicate, the document
+		document["orderid"] = "updated-by-upsert"
+		invokeErr = invokeWithDocument(ctx, "upsert", document, nil)
+		assert.NoError(t, invokeErr)
+
+		flow.Sleep(3 * time.Second)
+
+		result, _, dbclient = queryDocumentByID(document["id"].(string))
+		assert.Equal(t, "updated-by-upsert", result["orderid"])
+
+		_, err = dbclient.DeleteDocument(result["_self"].(string), documentdb.PartitionKey(result["partitionKey"].(string)))
+		assert.NoError(t, err)
+
+		return nil
+	}
+
+	testInvokeReplaceAndVerify := func(ctx flow.Context) error {
+		document := createDocument(true, true)
+		invokeErr := invokeCreateWithDocument(ctx, document)
+		assert.NoError(t, invokeErr)
+
+		flow.Sleep(3 * time.Second)
+
+		document["orderid"] = "replaced-order-id"
+		invokeErr = invokeWithDocument(ctx, "replace", document, nil)
+		assert.NoError(t, invokeErr)
+
+		flow.Sleep(3 * time.Second)
+
+		result, _, dbclient := queryDocumentByID(document["id"].(string))
+		assert.Equal(t, "replaced-order-id", result["orderid"])
+
+		_, err = dbclient.DeleteDocument(result["_self"].(string), documentdb.PartitionKey(result["partitionKey"].(string)))
+		assert.NoError(t, err)
+
+		return nil
+	}
+
+	testInvokePatchAndVerify := func(ctx flow.Context) error {
+		document := createDocument(true, true)
+		invokeErr := invokeCreateWithDocument(ctx, document)
+		assert.NoError(t, invokeErr)
+
+		flow.Sleep(3 * time.Second)
+
+		patch := map[string]interface{}{
+			"operations": []map[string]interface{}{
+				{"op": "replace", "path": "/orderid", "value": "patched-order-id"},
+				{"op": "add", "path": "/patchedField", "value": "patchedValue"},
+			},
+		}
+		invokeErr = invokeWithDocument(ctx, "patch", patch, map[string]string{
+			"id":           document["id"].(string),
+			"partitionKey": document["partitionKey"].(string),
+		})
+		assert.NoError(t, invokeErr)
+
+		flow.Sleep(3 * time.Second)
+
+		result, _, dbclient := queryDocumentByID(document["id"].(string))
+		assert.Equal(t, "patched-order-id", result["orderid"])
+		assert.Equal(t, "patchedValue", result["patchedField"])
+
+		_, err = dbclient.DeleteDocument(result["_self"].(string), documentdb.PartitionKey(result["partitionKey"].(string)))
+		assert.NoError(t, err)
+
+		return nil
+	}
+
+	testInvokeDeleteAndVerify := func(ctx flow.Context) error {
+		document := createDocument(true, true)
+		invokeErr := invokeCreateWithDocument(ctx, document)
+		assert.NoError(t, invokeErr)
+
+		flow.Sleep(3 * time.Second)
+
+		invokeErr = invokeWithDocument(ctx, "delete", map[string]interface{}{}, map[string]string{
+			"id":           document["id"].(string),
+			"partitionKey": document["partitionKey"].(string),
+		})
+		assert.NoError(t, invokeErr)
+
+		flow.Sleep(3 * time.Second)
+
+		result, _, _ := queryDocumentByID(document["id"].(string))
+		assert.Nil(t, result)
+
+		return nil
+	}
+
+	invokeWithMetadata := func(ctx flow.Context, operation string, data []byte, metadata map[string]string) ([]byte, map[string]string, error) {
+		client, clientErr := daprsdk.NewClientWithPort(fmt.Sprint(currentGRPCPort))
+		if clientErr != nil {
+			panic(clientErr)
+		}
+		defer client.Close()
+
+		invokeRequest := &daprsdk.InvokeBindingRequest{
+			Name:      "azure-cosmosdb-binding",
+			Operation: operation,
+			Data:      data,
+			Metadata:  metadata,
+		}
+
+		resp, invokeErr := client.InvokeBinding(ctx, invokeRequest)
+		if invokeErr != nil {
+			return nil, nil, invokeErr
+		}
+		return resp.Data, resp.Metadata, nil
+	}
+
+	testInvokeGetAndVerify := func(ctx flow.Context) error {
+		document := createDocument(true, true)
+		invokeErr := invokeCreateWithDocument(ctx, document)
+		assert.NoError(t, invokeErr)
+
+		flow.Sleep(3 * time.Second)
+
+		data, responseMetadata, invokeErr := invokeWithMetadata(ctx, "get", nil, map[string]string{
+			"id":           document["id"].(string),
+			"partitionKey": document["partitionKey"].(string),
+		})
+		assert.NoError(t, invokeErr)
+
+		var result map[string]interface{}
+		assert.NoError(t, json.Unmarshal(data, &result))
+		assert.Equal(t, document["id"], result["id"])
+		assert.Equal(t, document["orderid"], result["orderid"])
+
+		// applications implementing backoff / cost-aware routing rely on these.
+		assert.NotEmpty(t, responseMetadata["statusCode"])
+		assert.NotEmpty(t, responseMetadata["requestCharge"])
+		assert.NotEmpty(t, responseMetadata["activityId"])
+
+		resultFromDB, _, dbclient := queryDocumentByID(document["id"].(string))
+		_, err = dbclient.DeleteDocument(resultFromDB["_self"].(string), documentdb.PartitionKey(resultFromDB["partitionKey"].(string)))
+		assert.NoError(t, err)
+
+		return nil
+	}
+
+	// testInvokeCreateAndGetAgainstLocalEmulator exercises the binding only
+	// through its own get operation, unlike the equivalent flows above: the
+	// local fake doesn't speak the a8m/documentdb wire protocol queryDocumentByID relies on.
+	testInvokeCreateAndGetAgainstLocalEmulator := func(ctx flow.Context) error {
+		document := createDocument(true, true)
+		invokeErr := invokeCreateWithDocument(ctx, document)
+		assert.NoError(t, invokeErr)
+
+		data, responseMetadata, invokeErr := invokeWithMetadata(ctx, "get", nil, map[string]string{
+			"id":           document["id"].(string),
+			"partitionKey": document["partitionKey"].(string),
+		})
+		assert.NoError(t, invokeErr)
+
+		var result map[string]interface{}
+		assert.NoError(t, json.Unmarshal(data, &result))
+		assert.Equal(t, document["id"], result["id"])
+		assert.Equal(t, document["orderid"], result["orderid"])
+
+		assert.NotEmpty(t, responseMetadata["statusCode"])
+		assert.NotEmpty(t, responseMetadata["requestCharge"])
+		assert.NotEmpty(t, responseMetadata["activityId"])
+
+		invokeErr = invokeWithDocument(ctx, "delete", map[string]interface{}{}, map[string]string{
+			"id":           document["id"].(string),
+			"partitionKey": document["partitionKey"].(string),
+		})
+		assert.NoError(t, invokeErr)
+
+		return nil
+	}
+
+	testInvokeQueryAndVerify := func(ctx flow.Context) error {
+		document := createDocument(true, true)
+		invokeErr := invokeCreateWithDocument(ctx, document)
+		assert.NoError(t, invokeErr)
+
+		flow.Sleep(3 * time.Second)
+
+		queryBody, marshalErr := json.Marshal(map[string]interface{}{
+			"query": "SELECT * FROM ROOT r WHERE r.id=@id",
+			"parameters": []map[string]interface{}{
+				{"name": "@id", "value": document["id"]},
+			},
+		})
+		assert.NoError(t, marshalErr)
+
+		data, _, invokeErr := invokeWithMetadata(ctx, "query", queryBody, map[string]string{
+			"enableCrossPartition": "true",
+		})
+		assert.NoError(t, invokeErr)
+
+		var results []map[string]interface{}
+		assert.NoError(t, json.Unmarshal(data, &results))
+		assert.Len(t, results, 1)
+		assert.Equal(t, document["id"], results[0]["id"])
+
+		resultFromDB, _, dbclient := queryDocumentByID(document["id"].(string))
+		_, err = dbclient.DeleteDocument(resultFromDB["_self"].(string), documentdb.PartitionKey(resultFromDB["partitionKey"].(string)))
+		assert.NoError(t, err)
+
+		return nil
+	}
+
 	testInvokeCreateWithoutPartitionKey := func(ctx flow.Context) error {
 		document := createDocument(true, false)
 		invokeErr := invokeCreateWithDocument(ctx, document)
@@ -186,6 +417,57 @@ func TestCosmosDBBinding(t *testing.T) {
 		return nil
 	}
 
+	// testInvokeHierarchicalPartitionKey exercises a container configured with an
+	// N-level hierarchical partition key: the binding's partitionKey metadata is a
+	// JSON array of document field names, one per level, and the composite value is
+	// built by walking them in order. It also drives the binding's own get
+	// operation against the document, which is what exercises
+	// partitionKeyFromMetadataValue's JSON-array branch rather than
+	// partitionKeyFromDocument used by create.
+	testInvokeHierarchicalPartitionKey := func(pkFields []string) func(ctx flow.Context) error {
+		return func(ctx flow.Context) error {
+			document := createDocument(true, false)
+			for level, field := range pkFields {
+				document[field] = fmt.Sprintf("level-%d-value", level)
+			}
+
+			invokeErr := invokeCreateWithDocument(ctx, document)
+			assert.NoError(t, invokeErr)
+
+			flow.Sleep(3 * time.Second)
+
+			partitionKeyValues := make([]string, len(pkFields))
+			for i, field := range pkFields {
+				partitionKeyValues[i] = document[field].(string)
+			}
+			pkMetadataValue, marshalErr := json.Marshal(partitionKeyValues)
+			assert.NoError(t, marshalErr)
+
+			data, _, invokeErr := invokeWithMetadata(ctx, "get", nil, map[string]string{
+				"id":           document["id"].(string),
+				"partitionKey": string(pkMetadataValue),
+			})
+			assert.NoError(t, invokeErr)
+
+			var getResult map[string]interface{}
+			assert.NoError(t, json.Unmarshal(data, &getResult))
+			assert.Equal(t, document["id"], getResult["id"])
+			for _, field := range pkFields {
+				assert.Equal(t, document[field], getResult[field])
+			}
+
+			result, _, dbclient := queryDocumentByID(document["id"].(string))
+			for _, field := range pkFields {
+				assert.Equal(t, document[field], result[field])
+			}
+
+			_, err = dbclient.DeleteDocument(result["_self"].(string), documentdb.PartitionKey(partitionKeyValues))
+			assert.NoError(t, err)
+
+			return nil
+		}
+	}
+
 	flow.New(t, "cosmosdb binding authentication using service principal").
 		Step(sidecar.Run(sidecarName,
 			embedded.WithoutApp(),
@@ -229,6 +511,12 @@ func TestCosmosDBBinding(t *testing.T) {
 		Step("verify data sent to output binding is written to Cosmos DB", testInvokeCreateAndVerify).
 		Step("expect error if id is missing from document", testInvokeCreateWithoutID).
 		Step("expect error if partition key is missing from document", testInvokeCreateWithoutPartitionKey).
+		Step("verify upsert creates and then replaces a document", testInvokeUpsertAndVerify).
+		Step("verify replace overwrites an existing document", testInvokeReplaceAndVerify).
+		Step("verify patch applies a partial update to an existing document", testInvokePatchAndVerify).
+		Step("verify delete removes an existing document", testInvokeDeleteAndVerify).
+		Step("verify get fetches a document by id and partition key", testInvokeGetAndVerify).
+		Step("verify query returns documents matching a parameterized SQL query", testInvokeQueryAndVerify).
 		Run()
 
 	ports, err = dapr_testing.GetFreePorts(2)
@@ -255,4 +543,191 @@ func TestCosmosDBBinding(t *testing.T) {
 			))).
 		Step("verify error when wrong partition key used", testInvokeCreateWithWrongPartitionKey).
 		Run()
+
+	ports, err = dapr_testing.GetFreePorts(2)
+	assert.NoError(t, err)
+
+	currentGRPCPort = ports[0]
+	currentHTTPPort = ports[1]
+
+	flow.New(t, "cosmosdb binding with a two-level hierarchical partition key").
+		Step(sidecar.Run(sidecarName,
+			embedded.WithoutApp(),
+			embedded.WithComponentsPath("./components/twoLevelPartitionKey"),
+			embedded.WithDaprGRPCPort(currentGRPCPort),
+			embedded.WithDaprHTTPPort(currentHTTPPort),
+			runtime.WithSecretStores(
+				secretstores_loader.New("local.env", func() secretstores.SecretStore {
+					return secretstore_env.NewEnvSecretStore(log)
+				}),
+			),
+			runtime.WithOutputBindings(
+				bindings_loader.NewOutput("azure.cosmosdb", func() bindings.OutputBinding {
+					return cosmosdbbinding.NewCosmosDB(log)
+				}),
+			))).
+		Step("verify document written with a two-level partition key", testInvokeHierarchicalPartitionKey([]string{"tenantId", "userId"})).
+		Run()
+
+	ports, err = dapr_testing.GetFreePorts(2)
+	assert.NoError(t, err)
+
+	currentGRPCPort = ports[0]
+	currentHTTPPort = ports[1]
+
+	flow.New(t, "cosmosdb binding with a three-level hierarchical partition key").
+		Step(sidecar.Run(sidecarName,
+			embedded.WithoutApp(),
+			embedded.WithComponentsPath("./components/threeLevelPartitionKey"),
+			embedded.WithDaprGRPCPort(currentGRPCPort),
+			embedded.WithDaprHTTPPort(currentHTTPPort),
+			runtime.WithSecretStores(
+				secretstores_loader.New("local.env", func() secretstores.SecretStore {
+					return secretstore_env.NewEnvSecretStore(log)
+				}),
+			),
+			runtime.WithOutputBindings(
+				bindings_loader.NewOutput("azure.cosmosdb", func() bindings.OutputBinding {
+					return cosmosdbbinding.NewCosmosDB(log)
+				}),
+			))).
+		Step("verify document written with a three-level partition key", testInvokeHierarchicalPartitionKey([]string{"tenantId", "region", "deviceId"})).
+		Run()
+
+	// AzureCosmosDBLocalEmulator opts into running the suite below against an
+	// in-process fake of the Cosmos DB SQL API instead of a live account, so it
+	// can run in CI without Azure credentials. It is off by default because the
+	// fake only understands the narrow slice of the wire protocol this binding uses.
+	if os.Getenv("AzureCosmosDBLocalEmulator") == "true" {
+		fake := newFakeCosmosServer("partitionKey")
+		server := fake.Start()
+		defer server.Close()
+
+		os.Setenv("AzureCosmosDBUrl", server.URL)
+		os.Setenv("AzureCosmosDBMasterKey", "dGhpc2lzYWZha2VrZXlmb3J0ZXN0aW5nb25seQ==")
+		os.Setenv("AzureCosmosDB", "daprtest")
+		os.Setenv("AzureCosmosDBCollection", "daprtest_coll")
+
+		ports, err = dapr_testing.GetFreePorts(2)
+		assert.NoError(t, err)
+
+		currentGRPCPort = ports[0]
+		currentHTTPPort = ports[1]
+
+		flow.New(t, "cosmosdb binding against the local in-process fake").
+			Step(sidecar.Run(sidecarName,
+				embedded.WithoutApp(),
+				embedded.WithComponentsPath("./components/localemulator"),
+				embedded.WithDaprGRPCPort(currentGRPCPort),
+				embedded.WithDaprHTTPPort(currentHTTPPort),
+				runtime.WithSecretStores(
+					secretstores_loader.New("local.env", func() secretstores.SecretStore {
+						return secretstore_env.NewEnvSecretStore(log)
+					}),
+				),
+				runtime.WithOutputBindings(
+					bindings_loader.NewOutput("azure.cosmosdb", func() bindings.OutputBinding {
+						return cosmosdbbinding.NewCosmosDB(log)
+					}),
+				))).
+			Step("verify create and get round-trip against the fake", testInvokeCreateAndGetAgainstLocalEmulator).
+			Run()
+	}
 }
+
+// TestCosmosDBChangeFeedBinding verifies that documents written through the
+// output binding are delivered, in order per partition, by the change feed
+// input binding.
+func TestCosmosDBChangeFeedBinding(t *testing.T) {
+	ports, err := dapr_testing.GetFreePorts(3)
+	assert.NoError(t, err)
+
+	currentGRPCPort := ports[0]
+	currentHTTPPort := ports[1]
+	currentAppPort := ports[2]
+
+	log := logger.NewLogger("dapr.components")
+
+	var mu sync.Mutex
+	var received []map[string]interface{}
+
+	onChange := func(_ string, in *bindings.ReadResponse) ([]byte, error) {
+		var documents []map[string]interface{}
+		if err := json.Unmarshal(in.Data, &documents); err != nil {
+			return nil, err
+		}
+
+		mu.Lock()
+		received = append(received, documents...)
+		mu.Unlock()
+
+		return nil, nil
+	}
+
+	writeDocuments := func(ctx flow.Context) error {
+		client, clientErr := daprsdk.NewClientWithPort(fmt.Sprint(currentGRPCPort))
+		if clientErr != nil {
+			panic(clientErr)
+		}
+		defer client.Close()
+
+		for i := 0; i < 5; i++ {
+			document := createDocument(true, true)
+			document["sequence"] = i
+
+			bytesDoc, marshalErr := json.Marshal(document)
+			assert.NoError(t, marshalErr)
+
+			invokeErr := client.InvokeOutputBinding(ctx, &daprsdk.InvokeBindingRequest{
+				Name:      "azure-cosmosdb-binding",
+				Operation: "create",
+				Data:      bytesDoc,
+			})
+			assert.NoError(t, invokeErr)
+		}
+
+		return nil
+	}
+
+	verifyChangeFeedDelivery := func(ctx flow.Context) error {
+		flow.Sleep(10 * time.Second)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		assert.Len(t, received, 5)
+		for i, document := range received {
+			assert.Equal(t, float64(i), document["sequence"])
+		}
+
+		return nil
+	}
+
+	flow.New(t, "cosmosdb change feed binding delivers changes in order").
+		Step(app.Run(appID, fmt.Sprint(currentAppPort), app.WithBindingHandler("azure-cosmosdb-changefeed-binding", onChange))).
+		Step(sidecar.Run(sidecarName,
+			embedded.WithComponentsPath("./components/changefeed"),
+			embedded.WithAppProtocol(runtime.HTTPProtocol, fmt.Sprint(currentAppPort)),
+			embedded.WithDaprGRPCPort(currentGRPCPort),
+			embedded.WithDaprHTTPPort(currentHTTPPort),
+			runtime.WithSecretStores(
+				secretstores_loader.New("local.env", func() secretstores.SecretStore {
+					return secretstore_env.NewEnvSecretStore(log)
+				}),
+			),
+			runtime.WithOutputBindings(
+				bindings_loader.NewOutput("azure.cosmosdb", func() bindings.OutputBinding {
+					return cosmosdbbinding.NewCosmosDB(log)
+				}),
+			),
+			runtime.WithInputBindings(
+				bindings_loader.NewInput("azure.cosmosdb.changefeed", func() bindings.InputBinding {
+					return cosmosdbbinding.NewCosmosDBChangeFeedInput(log)
+				}),
+			))).
+		Step("write documents via the output binding", writeDocuments).
+		Step("verify the change feed binding delivered them in order", verifyChangeFeedDelivery).
+		Run()
+}
+
+const appID = "cosmosdb-changefeed-app"
@@ -0,0 +1,307 @@
+/*
+Copyright 2021 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cosmosdbbinding_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dapr/components-contrib/bindings"
+	cosmosdbbinding "github.com/dapr/components-contrib/bindings/azure/cosmosdb"
+	"github.com/dapr/components-contrib/metadata"
+	"github.com/dapr/kit/logger"
+)
+
+// fakeCosmosServer is a minimal stand-in for the Cosmos DB SQL (core) API:
+// just enough of CreateDocument, ReadDocument, DeleteDocument, and
+// QueryDocuments - including the same partition-key validation error strings
+// the real service returns - to drive TestCosmosDBBinding without an Azure
+// subscription or the JVM-based Cosmos DB emulator. It is not a general
+// emulator: the query engine only understands the
+// "SELECT * FROM ROOT r WHERE r.id=@id"-shaped queries this test suite issues.
+type fakeCosmosServer struct {
+	partitionKeyPaths []string
+
+	mu        sync.Mutex
+	documents map[string]map[string]interface{} // keyed by id
+}
+
+func newFakeCosmosServer(partitionKeyPaths ...string) *fakeCosmosServer {
+	if len(partitionKeyPaths) == 0 {
+		partitionKeyPaths = []string{"partitionKey"}
+	}
+	return &fakeCosmosServer{
+		partitionKeyPaths: partitionKeyPaths,
+		documents:         map[string]map[string]interface{}{},
+	}
+}
+
+// Start brings up the fake on an httptest TLS server (Cosmos DB is HTTPS-only)
+// and returns it so the caller can point the binding's url metadata at
+// server.URL and stop it with server.Close().
+func (f *fakeCosmosServer) Start() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(f.handle))
+}
+
+func (f *fakeCosmosServer) handle(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/docs") && isQueryRequest(r):
+		f.queryDocuments(w, r)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/docs"):
+		f.createDocument(w, r)
+	case r.Method == http.MethodGet:
+		f.readDocument(w, r)
+	case r.Method == http.MethodDelete:
+		f.deleteDocument(w, r)
+	default:
+		http.Error(w, fmt.Sprintf("fakeCosmosServer: unsupported %s %s", r.Method, r.URL.Path), http.StatusNotImplemented)
+	}
+}
+
+func isQueryRequest(r *http.Request) bool {
+	return r.Header.Get("Content-Type") == "application/query+json" || r.Header.Get("x-ms-documentdb-isquery") == "True"
+}
+
+// writeError replies with a Cosmos DB-shaped error body and sets the
+// x-ms-error-code header the real service sets, which azcore.ResponseError
+// reads to populate ErrorCode.
+func (f *fakeCosmosServer) writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"code":    code,
+		"message": message,
+	})
+}
+
+func (f *fakeCosmosServer) writeDocument(w http.ResponseWriter, statusCode int, document map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("x-ms-request-charge", "1")
+	w.Header().Set("x-ms-activity-id", "fake-activity-id")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(document)
+}
+
+// partitionKeyValues extracts this server's configured partition key path(s)
+// from a document, in order.
+func (f *fakeCosmosServer) partitionKeyValues(document map[string]interface{}) ([]string, bool) {
+	values := make([]string, 0, len(f.partitionKeyPaths))
+	for _, path := range f.partitionKeyPaths {
+		v, ok := document[path].(string)
+		if !ok {
+			return nil, false
+		}
+		values = append(values, v)
+	}
+	return values, true
+}
+
+func (f *fakeCosmosServer) createDocument(w http.ResponseWriter, r *http.Request) {
+	var document map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&document); err != nil {
+		f.writeError(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+
+	id, ok := document["id"].(string)
+	if !ok || id == "" {
+		f.writeError(w, http.StatusBadRequest, "BadRequest",
+			`Message: {"Errors":["One or more of the required properties - 'id; ' - are missing"]}`)
+		return
+	}
+
+	documentPK, ok := f.partitionKeyValues(document)
+	if !ok {
+		f.writeError(w, http.StatusBadRequest, "BadRequest", "PartitionKey field(s) are missing from the document")
+		return
+	}
+
+	headerPK, err := parsePartitionKeyHeader(r.Header.Get("x-ms-documentdb-partitionkey"))
+	if err != nil {
+		f.writeError(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	if !equalPartitionKeys(documentPK, headerPK) {
+		f.writeError(w, http.StatusBadRequest, "BadRequest",
+			"PartitionKey extracted from document doesn't match the one specified in the header")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.documents[id]; exists && r.Header.Get("x-ms-documentdb-is-upsert") != "true" {
+		f.writeError(w, http.StatusConflict, "Conflict", "Resource with specified id already exists")
+		return
+	}
+
+	document["_self"] = fmt.Sprintf("docs/%s", id)
+	f.documents[id] = document
+	f.writeDocument(w, http.StatusCreated, document)
+}
+
+func (f *fakeCosmosServer) readDocument(w http.ResponseWriter, r *http.Request) {
+	id := idFromPath(r.URL.Path)
+
+	f.mu.Lock()
+	document, ok := f.documents[id]
+	f.mu.Unlock()
+
+	if !ok {
+		f.writeError(w, http.StatusNotFound, "NotFound", "Resource Not Found")
+		return
+	}
+
+	f.writeDocument(w, http.StatusOK, document)
+}
+
+func (f *fakeCosmosServer) deleteDocument(w http.ResponseWriter, r *http.Request) {
+	id := idFromPath(r.URL.Path)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.documents[id]; !ok {
+		f.writeError(w, http.StatusNotFound, "NotFound", "Resource Not Found")
+		return
+	}
+
+	delete(f.documents, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queryRequestBody mirrors the shape Cosmos DB's REST API accepts for SQL
+// queries, and the shape this binding's query operation sends on.
+type queryRequestBody struct {
+	Query      string `json:"query"`
+	Parameters []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"parameters"`
+}
+
+func (f *fakeCosmosServer) queryDocuments(w http.ResponseWriter, r *http.Request) {
+	var body queryRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		f.writeError(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+
+	if !strings.Contains(body.Query, "r.id=@id") || len(body.Parameters) == 0 {
+		f.writeError(w, http.StatusBadRequest, "BadRequest", "fakeCosmosServer only supports SELECT * FROM ROOT r WHERE r.id=@id")
+		return
+	}
+	wantID := body.Parameters[0].Value
+
+	f.mu.Lock()
+	document, ok := f.documents[wantID]
+	f.mu.Unlock()
+
+	var results []map[string]interface{}
+	if ok {
+		results = append(results, document)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("x-ms-request-charge", "1")
+	w.Header().Set("x-ms-activity-id", "fake-activity-id")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"Documents": results})
+}
+
+func idFromPath(path string) string {
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	return parts[len(parts)-1]
+}
+
+func parsePartitionKeyHeader(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var values []string
+	if err := json.Unmarshal([]byte(raw), &values); err != nil {
+		return nil, fmt.Errorf("malformed x-ms-documentdb-partitionkey header: %w", err)
+	}
+	return values, nil
+}
+
+func equalPartitionKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestCosmosDBBindingTypedErrors drives the binding directly (bypassing the
+// sidecar, whose gRPC boundary would flatten the error back down to a string)
+// against the local fake, and verifies errors.Is/errors.As work against the
+// sentinels and *cosmosdbbinding.CosmosError documented on those types.
+func TestCosmosDBBindingTypedErrors(t *testing.T) {
+	fake := newFakeCosmosServer("partitionKey")
+	server := fake.Start()
+	defer server.Close()
+
+	log := logger.NewLogger("dapr.components")
+	binding := cosmosdbbinding.NewCosmosDB(log)
+
+	initErr := binding.Init(context.Background(), bindings.Metadata{
+		Base: metadata.Base{
+			Properties: map[string]string{
+				"url":                  server.URL,
+				"masterKey":            "dGhpc2lzYWZha2VrZXlmb3J0ZXN0aW5nb25seQ==",
+				"database":             "daprtest",
+				"collection":           "daprtest_coll",
+				"skipCertVerification": "true",
+			},
+		},
+	})
+	assert.NoError(t, initErr)
+
+	document := createDocument(true, true)
+	data, marshalErr := json.Marshal(document)
+	assert.NoError(t, marshalErr)
+
+	_, invokeErr := binding.Invoke(context.Background(), &bindings.InvokeRequest{
+		Operation: cosmosdbbinding.CreateOperation,
+		Data:      data,
+	})
+	assert.NoError(t, invokeErr)
+
+	_, invokeErr = binding.Invoke(context.Background(), &bindings.InvokeRequest{
+		Operation: cosmosdbbinding.CreateOperation,
+		Data:      data,
+	})
+	assert.Error(t, invokeErr)
+	assert.ErrorIs(t, invokeErr, cosmosdbbinding.ErrConflict)
+
+	var cosmosErr *cosmosdbbinding.CosmosError
+	if assert.ErrorAs(t, invokeErr, &cosmosErr) {
+		assert.Equal(t, http.StatusConflict, cosmosErr.StatusCode)
+		assert.Equal(t, "Conflict", cosmosErr.Code)
+	}
+}